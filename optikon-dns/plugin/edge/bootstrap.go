@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultBootstrapRefresh is how often a Bootstrap re-resolves the upstream
+// hostnames it was asked about, so that DNS changes on the bootstrap
+// resolvers themselves are picked up without a restart.
+const defaultBootstrapRefresh = 5 * time.Minute
+
+// Bootstrap resolves the hostnames of DoH/DoT upstreams using a fixed set of
+// plain-DNS resolvers, configured via the `bootstrap` Corefile directive.
+// It exists so the edge plugin never has to rely on the system resolver it
+// may itself be serving.
+type Bootstrap struct {
+	resolvers []string
+	client    *dns.Client
+
+	mu       sync.RWMutex
+	resolved map[string]string // hostname -> literal IP, most recently resolved
+
+	stop chan struct{}
+}
+
+// NewBootstrap returns a Bootstrap that queries the given "host:port"
+// resolvers in order until one answers.
+func NewBootstrap(resolvers []string) *Bootstrap {
+	return &Bootstrap{
+		resolvers: resolvers,
+		client:    &dns.Client{Net: "udp", Timeout: timeout},
+		resolved:  make(map[string]string),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Resolved returns the most recently resolved IP for addr's hostname (with
+// addr's port, if it has one), resolving the hostname on the spot if it
+// hasn't been resolved yet. It returns "" if addr is already a literal IP or
+// no resolver answered.
+func (b *Bootstrap) Resolved(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+
+	b.mu.RLock()
+	ip, ok := b.resolved[host]
+	b.mu.RUnlock()
+	if !ok {
+		ip = b.resolve(host)
+		if ip == "" {
+			return ""
+		}
+		b.store(host, ip)
+	}
+	if port == "" {
+		return ip
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// Run resolves every hostname in hosts immediately, then periodically
+// refreshes them until stopped.
+func (b *Bootstrap) Run(hosts []string) {
+	b.refresh(hosts)
+	ticker := time.NewTicker(defaultBootstrapRefresh)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.refresh(hosts)
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic refresh goroutine started by Run.
+func (b *Bootstrap) Stop() { close(b.stop) }
+
+func (b *Bootstrap) refresh(hosts []string) {
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		if ip := b.resolve(host); ip != "" {
+			b.store(host, ip)
+		}
+	}
+}
+
+// resolve queries each configured resolver in turn for an A record and
+// returns the first answer it gets.
+func (b *Bootstrap) resolve(host string) string {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	for _, resolver := range b.resolvers {
+		resolver = strings.TrimSpace(resolver)
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		resp, _, err := b.client.Exchange(m, resolver)
+		if err != nil || resp == nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String()
+			}
+		}
+	}
+	return ""
+}
+
+func (b *Bootstrap) store(host, ip string) {
+	b.mu.Lock()
+	b.resolved[host] = ip
+	b.mu.Unlock()
+}
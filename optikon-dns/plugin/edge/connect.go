@@ -21,6 +21,9 @@
 package edge
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
 	"time"
 
 	"github.com/coredns/coredns/request"
@@ -29,11 +32,23 @@ import (
 	"golang.org/x/net/context"
 )
 
+// dnsMessageContentType is the media type DoH uses to carry a wire-format
+// DNS message, per RFC 8484.
+const dnsMessageContentType = "application/dns-message"
+
 // Establishes a connection and forwards a message to the upstream proxy.
 func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
 
+	if p.trans == transportHTTPS {
+		return p.connectDoH(ctx, state, metric)
+	}
+
+	if p.trans == transportQUIC {
+		return p.connectQUIC(ctx, state, metric)
+	}
+
 	proto := state.Proto()
-	if forceTCP {
+	if forceTCP || p.trans == transportTCP || p.trans == transportTLS {
 		proto = "tcp"
 	}
 
@@ -48,20 +63,105 @@ func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, me
 		conn.UDPSize = 512
 	}
 
+	upstream := p.resolvedAddr()
+	start := time.Now()
+	p.dnstap.Query(p.trans, upstream, state.Req, start)
+
 	conn.SetWriteDeadline(time.Now().Add(timeout))
 	if err := conn.WriteMsg(state.Req); err != nil {
-		conn.Close() // not giving it back
+		p.drop(conn) // not giving it back
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
 		return nil, err
 	}
 
 	conn.SetReadDeadline(time.Now().Add(timeout))
 	ret, err := conn.ReadMsg()
 	if err != nil {
-		conn.Close() // not giving it back
+		p.drop(conn) // not giving it back
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
 		return nil, err
 	}
 
-	p.Yield(conn)
+	p.updateRTT(time.Since(start))
+
+	p.dnstap.Response(p.trans, upstream, ret, start, time.Since(start))
+	if metric {
+		recordRequest(upstream, p.trans, dns.RcodeToString[ret.Rcode], time.Since(start))
+	}
+
+	p.Yield(conn, proto)
 
 	return ret, nil
 }
+
+// connectDoH forwards a message to a DoH upstream using the POST form of
+// RFC 8484: the wire-format query is the request body, and the wire-format
+// reply is the response body, both tagged application/dns-message.
+func (p *Proxy) connectDoH(ctx context.Context, state request.Request, metric bool) (*dns.Msg, error) {
+
+	wire, err := state.Req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.rawURL, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	upstream := p.resolvedAddr()
+	start := time.Now()
+	p.dnstap.Query(p.trans, upstream, state.Req, start)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, &httpStatusError{resp.StatusCode}
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, err
+	}
+
+	p.updateRTT(time.Since(start))
+
+	p.dnstap.Response(p.trans, upstream, ret, start, time.Since(start))
+	if metric {
+		recordRequest(upstream, p.trans, dns.RcodeToString[ret.Rcode], time.Since(start))
+	}
+
+	return ret, nil
+}
+
+// httpStatusError reports a non-200 response from a DoH upstream.
+type httpStatusError struct{ code int }
+
+func (e *httpStatusError) Error() string { return "doh: unexpected status " + http.StatusText(e.code) }
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+)
+
+// Dnstap streams FORWARDER_QUERY/FORWARDER_RESPONSE messages, in the
+// standard dnstap framestream wire format, for every query this plugin
+// forwards upstream. It is populated from a Corefile `dnstap
+// unix:///path/to.sock [full]` or `dnstap tcp://host:port [full]` line.
+type Dnstap struct {
+	target string // the configured unix:// or tcp:// socket
+	full   bool   // attach the full wire-format message, not just metadata
+
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *framestream.Encoder
+}
+
+// NewDnstap dials target and returns a Dnstap ready to accept messages. full
+// controls whether complete wire-format query/response bytes are attached
+// to each message, as opposed to just the metadata dnstap normally carries.
+func NewDnstap(target string, full bool) (*Dnstap, error) {
+	network, addr := "unix", strings.TrimPrefix(target, "unix://")
+	if strings.HasPrefix(target, "tcp://") {
+		network, addr = "tcp", strings.TrimPrefix(target, "tcp://")
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := framestream.NewEncoder(conn, &framestream.EncoderOptions{
+		ContentType:   []byte("protobuf:dnstap.Dnstap"),
+		Bidirectional: true,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Dnstap{target: target, full: full, conn: conn, enc: enc}, nil
+}
+
+// Close flushes and closes the underlying connection.
+func (d *Dnstap) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enc.Flush()
+	return d.conn.Close()
+}
+
+// Query emits a FORWARDER_QUERY message describing a request about to be
+// sent to upstream, identified by trans and addr.
+func (d *Dnstap) Query(trans transport, addr string, m *dns.Msg, at time.Time) {
+	if d == nil {
+		return
+	}
+	msg := d.baseMessage(tap.Message_FORWARDER_QUERY, trans, addr)
+	sec, nsec := split(at)
+	msg.QueryTimeSec = &sec
+	msg.QueryTimeNsec = &nsec
+	if d.full {
+		if wire, err := m.Pack(); err == nil {
+			msg.QueryMessage = wire
+		}
+	}
+	d.send(msg)
+}
+
+// Response emits a FORWARDER_RESPONSE message describing a reply received
+// from upstream, identified by trans and addr, latency seconds after at.
+func (d *Dnstap) Response(trans transport, addr string, m *dns.Msg, at time.Time, latency time.Duration) {
+	if d == nil {
+		return
+	}
+	msg := d.baseMessage(tap.Message_FORWARDER_RESPONSE, trans, addr)
+	sec, nsec := split(at.Add(latency))
+	msg.ResponseTimeSec = &sec
+	msg.ResponseTimeNsec = &nsec
+	if d.full && m != nil {
+		if wire, err := m.Pack(); err == nil {
+			msg.ResponseMessage = wire
+		}
+	}
+	d.send(msg)
+}
+
+func (d *Dnstap) baseMessage(t tap.Message_Type, trans transport, addr string) *tap.Message {
+	msg := &tap.Message{Type: &t}
+
+	family := tap.SocketFamily_INET
+	proto := socketProtocolFor(trans)
+	msg.SocketFamily = &family
+	msg.SocketProtocol = &proto
+
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() == nil {
+				family = tap.SocketFamily_INET6
+			}
+			msg.ResponseAddress = ip
+			if p, err := parsePort(port); err == nil {
+				msg.ResponsePort = &p
+			}
+		}
+	}
+
+	return msg
+}
+
+// socketProtocolFor maps an edge transport onto the dnstap socket protocol
+// it rides on: DoH travels over TCP/TLS just like DoT.
+func socketProtocolFor(trans transport) tap.SocketProtocol {
+	switch trans {
+	case transportUDP:
+		return tap.SocketProtocol_UDP
+	default:
+		return tap.SocketProtocol_TCP
+	}
+}
+
+func (d *Dnstap) send(m *tap.Message) {
+	t := tap.Dnstap_MESSAGE
+	payload := &tap.Dnstap{Type: &t, Message: m}
+
+	frame, err := proto.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enc.Write(frame)
+}
+
+func split(t time.Time) (uint64, uint32) { return uint64(t.Unix()), uint32(t.Nanosecond()) }
+
+func parsePort(s string) (uint32, error) {
+	p, err := strconv.ParseUint(s, 10, 32)
+	return uint32(p), err
+}
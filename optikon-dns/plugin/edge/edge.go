@@ -91,11 +91,15 @@ type Edge struct {
 	// The set of services currently running at this edge site.
 	services Set
 
-	// The set of upstream proxies for forwarding requests.
-	proxies []*Proxy
+	// The ordered list of domain-specific upstream routes, each matched
+	// against the query name in turn (longest zone match wins). Populated
+	// from `[/zone/...]upstream...` tokens on the `edge`/`forward` directive;
+	// it also holds the fallback route, which routeFor skips.
+	routes []*route
 
-	// The policy for selecting the next upstream.
-	policy Policy
+	// The route used when no entry in routes claims the query, i.e. the
+	// one built from upstream tokens with no `[/zone/...]` prefix.
+	fallback *route
 
 	// The duration between proxy healthchecks.
 	healthCheckInterval time.Duration
@@ -118,15 +122,25 @@ type Edge struct {
 
 	// Forces TCP forwarding even when the initial request was UDP.
 	forceTCP bool
+
+	// Dnstap, if non-nil, streams FORWARDER_QUERY/FORWARDER_RESPONSE
+	// messages for every query forwarded upstream.
+	Dnstap *Dnstap
+
+	// Bootstrap, if non-nil, resolves this edge's DoH/DoT/DoQ upstream
+	// hostnames and must be stopped on shutdown to end its refresh goroutine.
+	Bootstrap *Bootstrap
 }
 
 // New returns a new Edge instance.
 func New() *Edge {
+	fallback := &route{policy: new(random)}
 	return &Edge{
 		maxUpstreamFails:    defaultMaxUpstreamFails,
 		tlsConfig:           new(tls.Config),
 		expire:              defaultExpire,
-		policy:              new(random),
+		fallback:            fallback,
+		routes:              []*route{fallback},
 		baseDomain:          ".",
 		healthCheckInterval: healthCheckDuration,
 		table:               NewConcurrentServiceTable(),
@@ -137,8 +151,14 @@ func New() *Edge {
 // Name implements the plugin.Handler interface.
 func (e *Edge) Name() string { return pluginName }
 
-// NumUpstreams returns the number of upstream proxies.
-func (e *Edge) NumUpstreams() int { return len(e.proxies) }
+// NumUpstreams returns the number of upstream proxies across every route.
+func (e *Edge) NumUpstreams() int {
+	n := 0
+	for _, r := range e.routes {
+		n += len(r.proxies)
+	}
+	return n
+}
 
 // ServeDNS implements the plugin.Handler interface.
 //
@@ -181,10 +201,14 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	// a trailing dot.)
 	requestedService := trimTrailingDot(state.Name())
 
+	tableSize.Set(float64(e.table.Len()))
+	serviceSetSize.Set(float64(len(e.services)))
+
 	// Determine if the requested service is running locally and write a reply
 	// with my ip if it is.
 	if !locFound && e.services.Contains(requestedService) {
 		writeAuthoritativeResponse(res, &state, e.ip)
+		routeDecisionCount.WithLabelValues(string(decisionLocalService)).Inc()
 		if dnsDebugMode {
 			log.Infof("requested service %s found running locally. returning my ip", requestedService)
 		}
@@ -202,15 +226,20 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 			closest = findClosestToPoint(edgeSites, e.geoCoords)
 		}
 		writeAuthoritativeResponse(res, &state, closest)
+		routeDecisionCount.WithLabelValues(string(decisionTableHit)).Inc()
 		if dnsDebugMode {
 			log.Infof("requested service %s found in table. returning its IP: %s", requestedService, closest.String())
 		}
 		return dns.RcodeSuccess, nil
 	}
 
-	// If we have no upstream proxies to forward to, fallthrough to the
-	// `proxy` plugin.
-	if e.NumUpstreams() == 0 {
+	// Find the route whose zone list matches this query (longest zone wins),
+	// falling back to the route built from un-prefixed upstream tokens. If
+	// it has no upstream proxies to forward to, fallthrough to the `proxy`
+	// plugin.
+	rt := e.routeFor(state.Name())
+	if len(rt.proxies) == 0 {
+		routeDecisionCount.WithLabelValues(string(decisionFallthrough)).Inc()
 		if dnsDebugMode {
 			log.Infoln("no upstream proxies to resolve request. falling through to `proxy` plugin")
 		}
@@ -223,22 +252,22 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 		log.Infof("forwarding request upstream: %+v", r)
 	}
 
-	// Forward the request to one of the upstream proxies.
+	// Forward the request to one of the matched route's upstream proxies.
 	fails := 0
 	var span, child ot.Span
 	var upstreamErr error
 	span = ot.SpanFromContext(ctx)
-	for _, proxy := range e.list() {
+	for _, proxy := range rt.list() {
 
 		if proxy.Down(e.maxUpstreamFails) {
 			fails++
-			if fails < len(e.proxies) {
+			if fails < len(rt.proxies) {
 				continue
 			}
 			// All upstream proxies are dead, assume healtcheck is completely broken and randomly
 			// select an upstream to connect to.
 			r := new(random)
-			proxy = r.List(e.proxies)[0]
+			proxy = r.List(rt.proxies)[0]
 		}
 
 		if span != nil {
@@ -270,7 +299,7 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 			if e.maxUpstreamFails != 0 {
 				proxy.Healthcheck()
 			}
-			if fails < len(e.proxies) {
+			if fails < len(rt.proxies) {
 				continue
 			}
 			break
@@ -294,6 +323,7 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 		// Write the response message.
 		w.WriteMsg(res)
 
+		routeDecisionCount.WithLabelValues(string(decisionForwarded)).Inc()
 		return dns.RcodeSuccess, nil
 	}
 
@@ -307,6 +337,7 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 
 	// If the request can't be resolved by anything upstream, or if all the upstreams
 	// are unresponsive, fall through to proxy.
+	routeDecisionCount.WithLabelValues(string(decisionFallthrough)).Inc()
 	if dnsDebugMode {
 		log.Infoln("no healthy upstream proxies. falling through to `proxy` plugin")
 	}
@@ -386,6 +417,3 @@ func (e *Edge) isAllowedDomain(name string) bool {
 	}
 	return true
 }
-
-// List returns a set of proxies to be used for this client depending on the policy in e.
-func (e *Edge) list() []*Proxy { return e.policy.List(e.proxies) }
@@ -21,30 +21,47 @@
 package edge
 
 import (
+	"net/http"
 	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
 
-// For HC we send to . IN NS +norec message to the upstream. Dial timeouts and empty
-// replies are considered fails, basically anything else constitutes a healthy upstream.
+// For HC we send to . IN NS message to the upstream when it speaks
+// plain DNS, DoT or DoQ, and a HEAD request to the endpoint when it speaks
+// DoH. Dial timeouts, non-200 statuses and empty replies are considered
+// fails; basically anything else constitutes a healthy upstream.
 
 // Check is used as the up.Func in the up.Probe.
 func (p *Proxy) Check() error {
-	err := p.sendHealthCheck()
+	var err error
+	switch p.trans {
+	case transportHTTPS:
+		err = p.sendHTTPHealthCheck()
+	case transportQUIC:
+		err = p.sendQUICHealthCheck()
+	default:
+		err = p.sendHealthCheck()
+	}
 	if err != nil {
-		atomic.AddUint32(&p.fails, 1)
+		fails := atomic.AddUint32(&p.fails, 1)
+		healthcheckFailureCount.WithLabelValues(p.resolvedAddr()).Set(float64(fails))
 		return err
 	}
 	atomic.StoreUint32(&p.fails, 0)
+	healthcheckFailureCount.WithLabelValues(p.resolvedAddr()).Set(0)
 	return nil
 }
 
-// Sends a healthcheck ping to the proxy.
+// Healthcheck kicks off an out-of-band Check, recording its result but
+// ignoring the error since the caller only wants the failure count updated.
+func (p *Proxy) Healthcheck() { p.Check() }
+
+// sendHealthCheck pings a plain DNS or DoT upstream.
 func (p *Proxy) sendHealthCheck() error {
 	hcping := new(dns.Msg)
 	hcping.SetQuestion(".", dns.TypeNS)
-	m, _, err := p.client.Exchange(hcping, p.addr)
+	m, _, err := p.client.Exchange(hcping, p.resolvedAddr())
 	if err != nil && m != nil {
 		if m.Response || m.Opcode == dns.OpcodeQuery {
 			err = nil
@@ -52,3 +69,22 @@ func (p *Proxy) sendHealthCheck() error {
 	}
 	return err
 }
+
+// sendHTTPHealthCheck pings a DoH upstream with a HEAD request, which
+// exercises the TLS handshake and HTTP round trip without spending a full
+// DNS query on it.
+func (p *Proxy) sendHTTPHealthCheck() error {
+	req, err := http.NewRequest(http.MethodHead, p.rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{resp.StatusCode}
+	}
+	return nil
+}
@@ -21,29 +21,41 @@
 package edge
 
 import (
+	"errors"
+
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
 	"golang.org/x/net/context"
 )
 
+var (
+	errNoEdge    = errors.New("no edge plugin installed")
+	errNoHealthy = errors.New("no healthy proxies")
+)
+
 // Forward forwards the request in state as-is. Unlike Lookup that adds EDNS0 suffix to the message.
 func (e *Edge) Forward(state request.Request) (*dns.Msg, error) {
 	if e == nil {
 		return nil, errNoEdge
 	}
 
+	rt := e.routeFor(state.Name())
+	if len(rt.proxies) == 0 {
+		return nil, errNoHealthy
+	}
+
 	fails := 0
 	var upstreamErr error
-	for _, proxy := range e.list() {
+	for _, proxy := range rt.list() {
 		if proxy.Down(e.maxUpstreamFails) {
 			fails++
-			if fails < len(e.proxies) {
+			if fails < len(rt.proxies) {
 				continue
 			}
 			// All upstream proxies are dead, assume healtcheck is complete broken and randomly
 			// select an upstream to connect to.
-			proxy = e.list()[0]
+			proxy = rt.list()[0]
 		}
 
 		// Make the connection and receive the response.
@@ -53,7 +65,7 @@ func (e *Edge) Forward(state request.Request) (*dns.Msg, error) {
 		upstreamErr = err
 
 		if err != nil {
-			if fails < len(e.proxies) {
+			if fails < len(rt.proxies) {
 				continue
 			}
 			break
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * NOTE: This software contains code derived from the Apache-licensed CoreDNS
+ * `forward` plugin (https://github.com/coredns/coredns/blob/master/plugin/forward/metrics.go),
+ * including various modifications by Cisco Systems, Inc.
+ */
+
+package edge
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeDecision labels the branch of ServeDNS that resolved a query, for
+// the edge_route_decisions_total counter.
+type routeDecision string
+
+const (
+	decisionLocalService routeDecision = "local_service"
+	decisionTableHit     routeDecision = "table_hit"
+	decisionForwarded    routeDecision = "forwarded"
+	decisionFallthrough  routeDecision = "fallthrough"
+)
+
+// Metrics for both halves of the edge plugin: the DNS-forwarding path
+// shared with CoreDNS's `forward` plugin, and the geo-routing path unique
+// to `edge`.
+var (
+	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "requests_total",
+		Help:      "Counter of requests made per upstream, transport and response code.",
+	}, []string{"upstream", "transport", "rcode"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "request_duration_seconds",
+		Buckets:   prometheus.DefBuckets,
+		Help:      "Histogram of the time each upstream request took.",
+	}, []string{"upstream"})
+
+	healthcheckFailureCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "healthcheck_failures",
+		Help:      "Gauge of consecutive healthcheck failures per upstream.",
+	}, []string{"upstream"})
+
+	routeDecisionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "route_decisions_total",
+		Help:      "Counter of how ServeDNS resolved each query.",
+	}, []string{"decision"})
+
+	tableSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "table_size",
+		Help:      "Gauge of the number of services in the downstream edge-site table.",
+	})
+
+	serviceSetSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "service_set_size",
+		Help:      "Gauge of the number of services running at this edge site.",
+	})
+)
+
+// errorRcodeLabel is the edge_requests_total "rcode" value recorded for a
+// query that never got a reply: a write or read failure, or a failure to
+// reach a DoH or DoQ upstream. A failed dial of a UDP, TCP or DoT connection
+// is not recorded.
+const errorRcodeLabel = "error"
+
+// recordRequest observes the outcome of a single upstream query against the
+// edge_requests_total and edge_request_duration_seconds metrics. rcode is
+// either a dns.RcodeToString entry or errorRcodeLabel.
+func recordRequest(upstream string, trans transport, rcode string, dur time.Duration) {
+	requestCount.WithLabelValues(upstream, trans.String(), rcode).Inc()
+	requestDuration.WithLabelValues(upstream).Observe(dur.Seconds())
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * NOTE: This software contains code derived from the Apache-licensed CoreDNS
+ * `forward` plugin (https://github.com/coredns/coredns/blob/master/plugin/forward/persistent.go),
+ * including various modifications by Cisco Systems, Inc.
+ */
+
+package edge
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheType distinguishes the wire transports whose connections get their
+// own LIFO stack in a connPool.
+type cacheType int
+
+const (
+	cacheUDP cacheType = iota
+	cacheTCP
+	cacheTLS
+	cacheTypeCount
+)
+
+// String returns the dns.Client network name of this stack's transport.
+func (t cacheType) String() string {
+	switch t {
+	case cacheTCP:
+		return "tcp"
+	case cacheTLS:
+		return "tcp-tls"
+	default:
+		return "udp"
+	}
+}
+
+// cacheTypeFor reports which stack a connection dialed with trans/proto
+// belongs in.
+func cacheTypeFor(trans transport, proto string) cacheType {
+	if trans == transportTLS {
+		return cacheTLS
+	}
+	if proto == "tcp" {
+		return cacheTCP
+	}
+	return cacheUDP
+}
+
+// persistConn wraps a cached *dns.Conn with the time it was stashed, so the
+// cleanup goroutine can tell how long it's been idle.
+type persistConn struct {
+	c    *dns.Conn
+	used time.Time
+}
+
+// maxPooledPerType caps how many idle connections a single proxy keeps per
+// transport, so a burst of traffic doesn't grow the pool without bound.
+const maxPooledPerType = 64
+
+// connPool is a Proxy's persistent connection cache: one LIFO stack per
+// transport, with a background goroutine that evicts entries idle for
+// longer than expire.
+type connPool struct {
+	mu     sync.Mutex
+	stacks [cacheTypeCount][]*persistConn
+	inUse  int32
+
+	expire int64 // time.Duration, accessed atomically so SetExpire is lock-free
+
+	stop chan struct{}
+}
+
+// newConnPool returns a connPool that evicts connections idle longer than
+// expire, checking every expire/4 (floored at one second).
+func newConnPool(expire time.Duration) *connPool {
+	p := &connPool{stop: make(chan struct{})}
+	atomic.StoreInt64(&p.expire, int64(expire))
+
+	go p.cleanup()
+
+	return p
+}
+
+// SetExpire updates how long an idle connection may sit in the pool before
+// the cleanup goroutine evicts it.
+func (p *connPool) SetExpire(expire time.Duration) { atomic.StoreInt64(&p.expire, int64(expire)) }
+
+// push stashes a connection for later reuse by pop.
+func (p *connPool) push(t cacheType, c *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.stacks[t]) >= maxPooledPerType {
+		c.Close()
+		return
+	}
+	p.stacks[t] = append(p.stacks[t], &persistConn{c: c, used: time.Now()})
+}
+
+// pop returns the most recently used cached connection for t, or nil if the
+// stack is empty.
+func (p *connPool) pop(t cacheType) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stack := p.stacks[t]
+	if len(stack) == 0 {
+		return nil
+	}
+	last := stack[len(stack)-1]
+	p.stacks[t] = stack[:len(stack)-1]
+	return last.c
+}
+
+// Len returns the number of idle connections currently cached.
+func (p *connPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.stacks {
+		n += len(s)
+	}
+	return n
+}
+
+// InUse returns the number of connections currently checked out of the pool.
+func (p *connPool) InUse() int { return int(atomic.LoadInt32(&p.inUse)) }
+
+// acquire marks a connection as checked out, for InUse accounting.
+func (p *connPool) acquire() { atomic.AddInt32(&p.inUse, 1) }
+
+// release marks a connection as returned (cached or closed), for InUse
+// accounting.
+func (p *connPool) release() { atomic.AddInt32(&p.inUse, -1) }
+
+// Stop shuts down the cleanup goroutine and closes every cached connection.
+func (p *connPool) Stop() {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.stacks {
+		for _, pc := range p.stacks[i] {
+			pc.c.Close()
+		}
+		p.stacks[i] = nil
+	}
+}
+
+// cleanup periodically drops connections that have been idle longer than
+// the pool's current expire. The wait between checks is expire/4 (floored
+// at one second), re-derived from the pool's current expire on every
+// iteration so a SetExpire call takes effect on the next check rather than
+// only once the pool is recreated.
+func (p *connPool) cleanup() {
+	for {
+		expire := time.Duration(atomic.LoadInt64(&p.expire))
+		tick := expire / 4
+		if tick < time.Second {
+			tick = time.Second
+		}
+		timer := time.NewTimer(tick)
+
+		select {
+		case <-timer.C:
+			cutoff := time.Now().Add(-expire)
+			p.mu.Lock()
+			for i := range p.stacks {
+				stack := p.stacks[i]
+				fresh := stack[:0]
+				for _, pc := range stack {
+					if pc.used.Before(cutoff) {
+						pc.c.Close()
+						continue
+					}
+					fresh = append(fresh, pc)
+				}
+				p.stacks[i] = fresh
+			}
+			p.mu.Unlock()
+		case <-p.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -21,10 +21,29 @@
 package edge
 
 import (
+	"fmt"
 	"math/rand"
+	"sort"
 	"sync/atomic"
+	"time"
 )
 
+// newPolicy returns the named Policy, or an error if name isn't recognized.
+func newPolicy(name string) (Policy, error) {
+	switch name {
+	case "random":
+		return new(random), nil
+	case "round_robin":
+		return new(roundRobin), nil
+	case "latency":
+		return new(latency), nil
+	case "p2c":
+		return new(p2c), nil
+	default:
+		return nil, fmt.Errorf("unknown policy %q", name)
+	}
+}
+
 // policyType tells the plugin what policy for selecting upstream it uses.
 type policyType int
 
@@ -64,6 +83,86 @@ func (r *random) List(p []*Proxy) []*Proxy {
 	return rnd
 }
 
+// The policy that orders upstreams by measured latency, fastest first. An
+// upstream with no measurement yet is placed at the front so it gets
+// probed, and a small jitter keeps all traffic from herding onto whichever
+// upstream happens to have the lowest EWMA.
+type latency struct{}
+
+// String returns the string representation of the latency policy.
+func (l *latency) String() string { return "latency" }
+
+// latencyJitter is how much a proxy's EWMA is randomly perturbed before
+// ranking, as a fraction of the EWMA itself.
+const latencyJitter = 0.10
+
+// List returns the given proxies ordered ascending by jittered EWMA RTT,
+// with unmeasured proxies first.
+func (l *latency) List(p []*Proxy) []*Proxy {
+	ordered := make([]*Proxy, len(p))
+	copy(ordered, p)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return jitteredRTT(ordered[i]) < jitteredRTT(ordered[j])
+	})
+	return ordered
+}
+
+// jitteredRTT returns 0 for an unmeasured proxy (so it sorts first), or its
+// EWMA perturbed by ±latencyJitter otherwise.
+func jitteredRTT(p *Proxy) time.Duration {
+	rtt := p.RTT()
+	if rtt == 0 {
+		return 0
+	}
+	delta := (rand.Float64()*2 - 1) * latencyJitter
+	return rtt + time.Duration(float64(rtt)*delta)
+}
+
+// The policy that picks two proxies at random and prefers the one with the
+// lower measured latency, a cheaper approximation of a full latency sort
+// that scales better when there are many upstreams.
+type p2c struct{}
+
+// String returns the string representation of the p2c policy.
+func (c *p2c) String() string { return "p2c" }
+
+// List puts two randomly chosen proxies at the front, faster one first,
+// followed by the rest in their original order.
+func (c *p2c) List(p []*Proxy) []*Proxy {
+	if len(p) < 3 {
+		return (&latency{}).List(p)
+	}
+
+	i := rand.Intn(len(p))
+	j := rand.Intn(len(p) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := p[i], p[j]
+	if rttOf(second) < rttOf(first) {
+		first, second = second, first
+	}
+
+	rest := make([]*Proxy, 0, len(p)-2)
+	for k, proxy := range p {
+		if k != i && k != j {
+			rest = append(rest, proxy)
+		}
+	}
+
+	return append([]*Proxy{first, second}, rest...)
+}
+
+// rttOf treats an unmeasured proxy as having the lowest possible latency,
+// so it's preferred over a measured one and gets probed.
+func rttOf(p *Proxy) time.Duration {
+	if rtt := p.RTT(); rtt != 0 {
+		return rtt
+	}
+	return -1
+}
+
 // The policy that selects hosts based on round robin ordering.
 type roundRobin struct {
 	robin uint32
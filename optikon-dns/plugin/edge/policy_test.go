@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a Proxy with its RTT EWMA seeded to rtt, or left
+// unmeasured (0) when rtt is 0.
+func newTestProxy(rtt time.Duration) *Proxy {
+	p := &Proxy{}
+	if rtt != 0 {
+		p.updateRTT(rtt)
+	}
+	return p
+}
+
+func TestLatencyListOrdersAscendingByRTT(t *testing.T) {
+	fast := newTestProxy(10 * time.Millisecond)
+	slow := newTestProxy(500 * time.Millisecond)
+	unmeasured := newTestProxy(0)
+
+	ordered := (&latency{}).List([]*Proxy{slow, fast, unmeasured})
+
+	if ordered[0] != unmeasured {
+		t.Fatalf("expected the unmeasured proxy first, got %v", ordered)
+	}
+	if ordered[1] != fast || ordered[2] != slow {
+		t.Fatalf("expected the faster proxy before the slower one, got %v", ordered)
+	}
+}
+
+func TestLatencyListDoesNotMutateInput(t *testing.T) {
+	a := newTestProxy(5 * time.Millisecond)
+	b := newTestProxy(50 * time.Millisecond)
+	in := []*Proxy{b, a}
+
+	(&latency{}).List(in)
+
+	if in[0] != b || in[1] != a {
+		t.Fatalf("List must not reorder its input slice, got %v", in)
+	}
+}
+
+func TestJitteredRTTUnmeasuredIsZero(t *testing.T) {
+	if got := jitteredRTT(newTestProxy(0)); got != 0 {
+		t.Fatalf("jitteredRTT(unmeasured) = %v, want 0", got)
+	}
+}
+
+func TestJitteredRTTStaysWithinJitterBound(t *testing.T) {
+	p := newTestProxy(100 * time.Millisecond)
+	lo := time.Duration(float64(p.RTT()) * (1 - latencyJitter))
+	hi := time.Duration(float64(p.RTT()) * (1 + latencyJitter))
+
+	for i := 0; i < 100; i++ {
+		if got := jitteredRTT(p); got < lo || got > hi {
+			t.Fatalf("jitteredRTT() = %v, want within [%v, %v]", got, lo, hi)
+		}
+	}
+}
+
+func TestRTTOfUnmeasuredSortsBeforeMeasured(t *testing.T) {
+	measured := newTestProxy(10 * time.Millisecond)
+	unmeasured := newTestProxy(0)
+
+	if rttOf(unmeasured) >= rttOf(measured) {
+		t.Fatalf("expected an unmeasured proxy's rttOf to sort before a measured one")
+	}
+}
+
+func TestP2CFallsBackToLatencyBelowThreeProxies(t *testing.T) {
+	fast := newTestProxy(10 * time.Millisecond)
+	slow := newTestProxy(500 * time.Millisecond)
+
+	ordered := (&p2c{}).List([]*Proxy{slow, fast})
+
+	if ordered[0] != fast || ordered[1] != slow {
+		t.Fatalf("expected p2c to fall back to latency order for fewer than 3 proxies, got %v", ordered)
+	}
+}
+
+func TestP2CReturnsEveryProxy(t *testing.T) {
+	proxies := []*Proxy{
+		newTestProxy(10 * time.Millisecond),
+		newTestProxy(time.Second),
+		newTestProxy(2 * time.Second),
+	}
+
+	for i := 0; i < 20; i++ {
+		ordered := (&p2c{}).List(proxies)
+		if len(ordered) != len(proxies) {
+			t.Fatalf("List returned %d proxies, want %d", len(ordered), len(proxies))
+		}
+		seen := make(map[*Proxy]bool, len(ordered))
+		for _, p := range ordered {
+			seen[p] = true
+		}
+		for _, p := range proxies {
+			if !seen[p] {
+				t.Fatalf("List dropped a proxy: %v missing from %v", p, ordered)
+			}
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * NOTE: This software contains code derived from the Apache-licensed CoreDNS
+ * `forward` plugin (https://github.com/coredns/coredns/blob/master/plugin/forward/proxy.go),
+ * including various modifications by Cisco Systems, Inc.
+ */
+
+package edge
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// transport identifies the wire protocol a Proxy speaks to its upstream.
+type transport int
+
+const (
+	// transportUDP is plain DNS over UDP; a query that arrived over TCP, or
+	// any query under force_tcp, is sent over TCP instead.
+	transportUDP transport = iota
+	// transportTCP is plain DNS over TCP.
+	transportTCP
+	// transportTLS is DNS-over-TLS (DoT, RFC 7858).
+	transportTLS
+	// transportHTTPS is DNS-over-HTTPS (DoH, RFC 8484).
+	transportHTTPS
+	// transportQUIC is DNS-over-QUIC (DoQ, RFC 9250).
+	transportQUIC
+)
+
+// String returns the transport's short name, used as the metrics
+// "transport" label. For tls, https and quic it is also the URL scheme that
+// selects the transport in a Corefile; plain upstreams carry no scheme.
+func (t transport) String() string {
+	switch t {
+	case transportTCP:
+		return "tcp"
+	case transportTLS:
+		return "tls"
+	case transportHTTPS:
+		return "https"
+	case transportQUIC:
+		return "quic"
+	default:
+		return "udp"
+	}
+}
+
+const (
+	dialTimeout         = 30 * time.Second
+	timeout             = 5 * time.Second
+	healthCheckDuration = 500 * time.Millisecond
+)
+
+// Proxy defines an upstream host we forward requests to. It knows how to
+// reach the host over its configured transport and tracks consecutive
+// healthcheck failures.
+type Proxy struct {
+	fails uint32
+
+	trans transport
+
+	// addr is the dial target for transportUDP/transportTCP/transportTLS
+	// ("host:port"). For transportHTTPS it is the endpoint's host:port,
+	// used for bootstrap resolution and as the address the HTTP client
+	// dials; the HTTP requests themselves (queries and the healthcheck)
+	// are addressed to rawURL.
+	addr string
+
+	// rawURL is the configured DoH endpoint, e.g. "https://dns.example/dns-query".
+	// It is empty for every other transport.
+	rawURL string
+
+	client     *dns.Client
+	httpClient *http.Client
+
+	tlsConfig     *tls.Config
+	tlsServerName string
+
+	// bootstrap resolves addr/rawURL's hostname to an IP using a resolver
+	// that does not depend on this plugin, and keeps that answer fresh.
+	// It is nil unless a `bootstrap` directive was given and at least one
+	// upstream in the block is a hostname; a literal-IP addr is dialed as is.
+	bootstrap *Bootstrap
+
+	// pool caches idle connections for reuse between queries. It is nil for
+	// transportHTTPS and transportQUIC, which multiplex over their own
+	// long-lived connection instead of a pool of short-lived ones.
+	pool *connPool
+
+	// quicSess holds the shared quic.Connection for transportQUIC. It is nil
+	// for every other transport.
+	quicSess *quicSession
+
+	// dnstap, if non-nil, receives a FORWARDER_QUERY/FORWARDER_RESPONSE
+	// pair for every query sent through this proxy.
+	dnstap *Dnstap
+
+	// rtt is an EWMA of successful reply latency, in nanoseconds, used by
+	// the latency and p2c policies. Zero means unmeasured. Accessed
+	// atomically since it's updated from connect() and read from List().
+	rtt int64
+}
+
+// rttEWMAWeight is how much a fresh sample moves the running average; the
+// rest carries over from the previous value.
+const rttEWMAWeight = 0.3
+
+// updateRTT folds a fresh successful-reply latency into this proxy's EWMA.
+func (p *Proxy) updateRTT(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&p.rtt)
+		var next int64
+		if old == 0 {
+			next = int64(d)
+		} else {
+			next = int64(rttEWMAWeight*float64(d) + (1-rttEWMAWeight)*float64(old))
+		}
+		if atomic.CompareAndSwapInt64(&p.rtt, old, next) {
+			return
+		}
+	}
+}
+
+// RTT returns this proxy's current latency EWMA, or 0 if it has never
+// completed a successful query.
+func (p *Proxy) RTT() time.Duration { return time.Duration(atomic.LoadInt64(&p.rtt)) }
+
+// NewProxy returns a new Proxy for addr, speaking trans. tlsConfig may be nil
+// for transportUDP/transportTCP.
+func NewProxy(trans transport, addr string, tlsConfig *tls.Config) *Proxy {
+	p := &Proxy{
+		trans:     trans,
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}
+
+	switch trans {
+	case transportHTTPS:
+		p.rawURL = addr
+		p.addr = hostPortFromURL(addr)
+		p.httpClient = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				MaxIdleConns:        maxUpstreams,
+				MaxIdleConnsPerHost: maxUpstreams,
+				IdleConnTimeout:     defaultExpire,
+				// Dial the bootstrap-resolved IP instead of letting the
+				// transport re-resolve the hostname itself; addr is left
+				// untouched so the TLS handshake still verifies against it.
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, network, p.resolvedAddr())
+				},
+			},
+		}
+	case transportQUIC:
+		p.quicSess = newQUICSession(p.resolvedAddr, tlsConfig)
+	case transportTLS:
+		p.client = &dns.Client{Net: "tcp-tls", TLSConfig: tlsConfig, Timeout: timeout}
+	case transportTCP:
+		p.client = &dns.Client{Net: "tcp", Timeout: timeout}
+	default:
+		p.client = &dns.Client{Net: "udp", Timeout: timeout}
+	}
+
+	if trans != transportHTTPS && trans != transportQUIC {
+		p.pool = newConnPool(defaultExpire)
+	}
+
+	return p
+}
+
+// hostPortFromURL extracts the "host:port" dial target from a DoH URL,
+// defaulting to port 443 when none is given.
+func hostPortFromURL(rawURL string) string {
+	host := rawURL
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host = host[:i]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	return host
+}
+
+// Dial returns a cached connection to p.addr for proto ("udp" or "tcp"; TLS
+// is implied by p.trans) if one is available, otherwise it opens a new one.
+// It is unused for transportHTTPS, which speaks HTTP instead of the DNS wire
+// protocol directly.
+func (p *Proxy) Dial(proto string) (*dns.Conn, error) {
+	p.pool.acquire()
+
+	if c := p.pool.pop(cacheTypeFor(p.trans, proto)); c != nil {
+		return c, nil
+	}
+
+	addr := p.resolvedAddr()
+	if p.trans == transportTLS {
+		c, err := dns.DialTimeoutWithTLS("tcp", addr, p.tlsConfig, dialTimeout)
+		if err != nil {
+			p.pool.release()
+		}
+		return c, err
+	}
+	c, err := dns.DialTimeout(proto, addr, dialTimeout)
+	if err != nil {
+		p.pool.release()
+	}
+	return c, err
+}
+
+// Yield returns a connection dialed with proto ("udp" or "tcp") back to the
+// pool for reuse by a later query over the same transport.
+func (p *Proxy) Yield(c *dns.Conn, proto string) {
+	defer p.pool.release()
+	p.pool.push(cacheTypeFor(p.trans, proto), c)
+}
+
+// drop discards a connection that can't be reused (a write/read error, or a
+// UDP reply that never arrived) instead of yielding it back to the pool.
+func (p *Proxy) drop(c *dns.Conn) {
+	c.Close()
+	p.pool.release()
+}
+
+// Len returns the number of idle connections currently cached for this
+// proxy.
+func (p *Proxy) Len() int {
+	if p.pool == nil {
+		return 0
+	}
+	return p.pool.Len()
+}
+
+// InUse returns the number of connections currently checked out of this
+// proxy's pool.
+func (p *Proxy) InUse() int {
+	if p.pool == nil {
+		return 0
+	}
+	return p.pool.InUse()
+}
+
+// Stop shuts down this proxy's connection pool, closing every cached
+// connection. It is called when the plugin is torn down.
+func (p *Proxy) Stop() {
+	if p.pool != nil {
+		p.pool.Stop()
+	}
+	if p.quicSess != nil {
+		p.quicSess.reset()
+	}
+}
+
+// resolvedAddr returns the address to dial: the bootstrap-resolved IP when
+// the upstream was configured as a hostname, or the literal addr otherwise.
+func (p *Proxy) resolvedAddr() string {
+	if p.bootstrap == nil {
+		return p.addr
+	}
+	if ip := p.bootstrap.Resolved(p.addr); ip != "" {
+		return ip
+	}
+	return p.addr
+}
+
+// splitHostPortLoose is net.SplitHostPort without the requirement that port
+// be present; it returns addr unchanged as the host when there's no port.
+func splitHostPortLoose(addr string) (host, port string, err error) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p, nil
+	}
+	return addr, "", nil
+}
+
+// isHostname reports whether host is a name that needs resolving, as
+// opposed to a literal IPv4 or IPv6 address.
+func isHostname(host string) bool { return net.ParseIP(host) == nil }
+
+// Down returns true if this proxy is consecutively failing more than
+// maxfails times, and fails is not 0.
+func (p *Proxy) Down(maxfails uint32) bool {
+	if maxfails == 0 {
+		return false
+	}
+	fails := atomic.LoadUint32(&p.fails)
+	return fails > maxfails
+}
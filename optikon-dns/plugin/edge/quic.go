@@ -0,0 +1,230 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// alpnDoQ is the ALPN token DoQ upstreams expect during the TLS handshake,
+// per RFC 9250.
+const alpnDoQ = "doq"
+
+// quicSession holds the single long-lived quic.Connection a Proxy multiplexes
+// its queries over, opening a fresh bidirectional stream per query rather
+// than a new connection.
+type quicSession struct {
+	// addr returns the address to dial, re-evaluated on every redial so a
+	// bootstrap-resolved IP that changes is picked up (see Proxy.resolvedAddr).
+	addr      func() string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+// newQUICSession returns a quicSession that will dial addr() on demand, using
+// a copy of tlsConfig with NextProtos forced to alpnDoQ.
+func newQUICSession(addr func() string, tlsConfig *tls.Config) *quicSession {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{alpnDoQ}
+	return &quicSession{addr: addr, tlsConfig: cfg}
+}
+
+// connection returns the current quic.Connection, dialing a new one if
+// there isn't one yet or the last one is no longer active (0-RTT rejection
+// or idle timeout both surface as a closed connection here).
+func (s *quicSession) connection() (quic.Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		select {
+		case <-s.conn.Context().Done():
+			s.conn = nil
+		default:
+			return s.conn, nil
+		}
+	}
+
+	conn, err := quic.DialAddr(s.addr(), s.tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// reset drops the current connection so the next connection() call reconnects.
+func (s *quicSession) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.CloseWithError(0, "")
+		s.conn = nil
+	}
+}
+
+// syncStream wraps a quic.Stream so Close can never run concurrently with a
+// Write in flight on the same stream, which quic-go otherwise allows to race.
+type syncStream struct {
+	mu sync.Mutex
+	quic.Stream
+}
+
+func (s *syncStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stream.Write(p)
+}
+
+func (s *syncStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stream.Close()
+}
+
+// connectQUIC forwards a message to a DoQ upstream: a fresh bidirectional
+// stream on the shared quic.Connection, the query written with its two-byte
+// length prefix, then the length-prefixed reply read back.
+func (p *Proxy) connectQUIC(ctx context.Context, state request.Request, metric bool) (*dns.Msg, error) {
+	upstream := p.resolvedAddr()
+
+	conn, err := p.quicSess.connection()
+	if err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, 0)
+		}
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		p.quicSess.reset()
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, 0)
+		}
+		return nil, err
+	}
+	s := &syncStream{Stream: stream}
+	defer s.Close()
+
+	start := time.Now()
+	p.dnstap.Query(p.trans, upstream, state.Req, start)
+
+	if err := writeDoQMessage(s, state.Req); err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, err
+	}
+
+	ret, err := readDoQMessage(s)
+	if err != nil {
+		if metric {
+			recordRequest(upstream, p.trans, errorRcodeLabel, time.Since(start))
+		}
+		return nil, err
+	}
+
+	p.updateRTT(time.Since(start))
+	p.dnstap.Response(p.trans, upstream, ret, start, time.Since(start))
+	if metric {
+		recordRequest(upstream, p.trans, dns.RcodeToString[ret.Rcode], time.Since(start))
+	}
+
+	return ret, nil
+}
+
+// writeDoQMessage packs m and writes it to s with the two-byte length
+// prefix required by RFC 9250.
+func writeDoQMessage(s *syncStream, m *dns.Msg) error {
+	wire, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	s.SetWriteDeadline(time.Now().Add(timeout))
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(wire)))
+	_, err = s.Write(append(length, wire...))
+	return err
+}
+
+// readDoQMessage reads a two-byte length prefix followed by that many bytes
+// of wire-format DNS message from s.
+func readDoQMessage(s *syncStream) (*dns.Msg, error) {
+	s.SetReadDeadline(time.Now().Add(timeout))
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(s, length); err != nil {
+		return nil, err
+	}
+
+	wire := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(s, wire); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(wire); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sendQUICHealthCheck sends ". IN NS" over a fresh stream, mirroring the
+// plain-DNS healthcheck's query.
+func (p *Proxy) sendQUICHealthCheck() error {
+	conn, err := p.quicSess.connection()
+	if err != nil {
+		return err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		p.quicSess.reset()
+		return err
+	}
+	s := &syncStream{Stream: stream}
+	defer s.Close()
+
+	hcping := new(dns.Msg)
+	hcping.SetQuestion(".", dns.TypeNS)
+	if err := writeDoQMessage(s, hcping); err != nil {
+		return err
+	}
+
+	m, err := readDoQMessage(s)
+	if err != nil {
+		return err
+	}
+	if !m.Response && m.Opcode != dns.OpcodeQuery {
+		return fmt.Errorf("doq: unexpected healthcheck reply")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import "github.com/coredns/coredns/plugin"
+
+// route pairs a set of upstream proxies and a selection policy with the DNS
+// zones they should be used for, mirroring the AdGuard-style
+// `[/zone1/zone2/]upstream...` syntax. A route with no zones is the
+// fallback: it matches every query that no other route claimed.
+type route struct {
+	zones   []string
+	proxies []*Proxy
+	policy  Policy
+}
+
+// isFallback reports whether r has no explicit zones, which makes it the
+// route routeFor falls back to. matches reports false for every name on
+// such a route.
+func (r *route) isFallback() bool { return len(r.zones) == 0 }
+
+// matches reports whether name falls under one of r's zones.
+func (r *route) matches(name string) bool {
+	for _, z := range r.zones {
+		if plugin.Name(z).Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns r's proxies ordered according to r's policy.
+func (r *route) list() []*Proxy { return r.policy.List(r.proxies) }
+
+// addRoutes merges freshly parsed routes into e: zoned routes are appended
+// as new entries, while a route with no zones (upstreams given with no
+// `[/zone/...]` prefix) is merged into e's existing fallback route.
+func (e *Edge) addRoutes(routes []*route) {
+	for _, r := range routes {
+		if r.isFallback() {
+			e.fallback.proxies = append(e.fallback.proxies, r.proxies...)
+			continue
+		}
+		e.routes = append(e.routes, r)
+	}
+}
+
+// allProxies returns every proxy across every route, zoned and fallback.
+func (e *Edge) allProxies() []*Proxy {
+	var all []*Proxy
+	for _, r := range e.routes {
+		all = append(all, r.proxies...)
+	}
+	return all
+}
+
+// routeFor returns the route whose zone list matches name with the longest
+// matching zone, falling back to e's fallback route (which may itself have
+// no proxies) when nothing more specific matches.
+func (e *Edge) routeFor(name string) *route {
+	var best *route
+	bestLen := -1
+	for _, r := range e.routes {
+		if r.isFallback() {
+			continue
+		}
+		for _, z := range r.zones {
+			if !plugin.Name(z).Matches(name) {
+				continue
+			}
+			if len(z) > bestLen {
+				bestLen = len(z)
+				best = r
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return e.fallback
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge
+
+import "testing"
+
+func TestParseZonePrefix(t *testing.T) {
+	cases := []struct {
+		in    string
+		zones []string
+		ok    bool
+	}{
+		{"[/example.com/]", []string{"example.com"}, true},
+		{"[/a.com/b.com/]", []string{"a.com", "b.com"}, true},
+		{"[//]", nil, true},
+		{"plain.example.com", nil, false},
+		{"[/no-trailing-slash", nil, false},
+	}
+
+	for _, c := range cases {
+		zones, ok := parseZonePrefix(c.in)
+		if ok != c.ok {
+			t.Fatalf("parseZonePrefix(%q): ok = %v, want %v", c.in, ok, c.ok)
+		}
+		if !ok {
+			continue
+		}
+		if len(zones) != len(c.zones) {
+			t.Fatalf("parseZonePrefix(%q): zones = %v, want %v", c.in, zones, c.zones)
+		}
+		for i := range zones {
+			if zones[i] != c.zones[i] {
+				t.Fatalf("parseZonePrefix(%q): zones = %v, want %v", c.in, zones, c.zones)
+			}
+		}
+	}
+}
+
+func TestRouteMatchesAndIsFallback(t *testing.T) {
+	fallback := &route{}
+	zoned := &route{zones: []string{"example.com."}}
+
+	if !fallback.isFallback() {
+		t.Fatal("expected a route with no zones to be the fallback")
+	}
+	if zoned.isFallback() {
+		t.Fatal("expected a route with zones not to be the fallback")
+	}
+	if !zoned.matches("foo.example.com.") {
+		t.Fatal("expected the zoned route to match a subdomain of its zone")
+	}
+	if zoned.matches("foo.other.com.") {
+		t.Fatal("expected the zoned route not to match outside its zone")
+	}
+}
+
+func TestRouteForPicksLongestZoneMatch(t *testing.T) {
+	outer := &route{zones: []string{"example.com."}, policy: new(random)}
+	inner := &route{zones: []string{"corp.example.com."}, policy: new(random)}
+	fb := &route{policy: new(random)}
+
+	e := &Edge{routes: []*route{outer, inner}, fallback: fb}
+
+	if got := e.routeFor("svc.corp.example.com."); got != inner {
+		t.Fatalf("routeFor(svc.corp.example.com.) = %v, want the more specific zone %v", got, inner)
+	}
+	if got := e.routeFor("svc.example.com."); got != outer {
+		t.Fatalf("routeFor(svc.example.com.) = %v, want %v", got, outer)
+	}
+	if got := e.routeFor("svc.unrelated.com."); got != fb {
+		t.Fatalf("routeFor(svc.unrelated.com.) = %v, want the fallback route", got)
+	}
+}
+
+func TestRouteListUsesItsPolicy(t *testing.T) {
+	p1, p2 := &Proxy{}, &Proxy{}
+	r := &route{proxies: []*Proxy{p1, p2}, policy: new(roundRobin)}
+
+	got := r.list()
+	if len(got) != 2 {
+		t.Fatalf("list() returned %d proxies, want 2", len(got))
+	}
+	// roundRobin advances its counter before indexing, so its first List
+	// call starts at the second proxy.
+	if got[0] != p2 || got[1] != p1 {
+		t.Fatalf("list() = %v, want the round robin order [p2 p1]", got)
+	}
+}
+
+func TestAddRoutesMergesUnzonedIntoFallback(t *testing.T) {
+	fb := &route{policy: new(random)}
+	e := &Edge{fallback: fb, routes: []*route{fb}}
+	p := &Proxy{}
+
+	e.addRoutes([]*route{{proxies: []*Proxy{p}}})
+
+	if len(fb.proxies) != 1 || fb.proxies[0] != p {
+		t.Fatalf("expected the unzoned route's proxies to be merged into the fallback, got %v", fb.proxies)
+	}
+	if len(e.routes) != 1 {
+		t.Fatalf("expected no new zoned route to be appended, got %d routes", len(e.routes))
+	}
+}
+
+func TestAddRoutesAppendsZonedRoutes(t *testing.T) {
+	fb := &route{policy: new(random)}
+	e := &Edge{fallback: fb, routes: []*route{fb}}
+	zoned := &route{zones: []string{"example.com."}, policy: new(random), proxies: []*Proxy{{}}}
+
+	e.addRoutes([]*route{zoned})
+
+	if len(e.routes) != 2 || e.routes[1] != zoned {
+		t.Fatalf("expected the zoned route to be appended to e.routes, got %v", e.routes)
+	}
+}
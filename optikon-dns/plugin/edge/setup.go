@@ -0,0 +1,317 @@
+/*
+ * Copyright 2018 The CoreDNS Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may
+ * not use this file except in compliance with the License. You may obtain
+ * a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * NOTE: This software contains code derived from the Apache-licensed CoreDNS
+ * `forward` plugin (https://github.com/coredns/coredns/blob/master/plugin/forward/setup.go),
+ * including various modifications by Cisco Systems, Inc.
+ */
+
+package edge
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+)
+
+func init() {
+	caddy.RegisterPlugin(pluginName, caddy.Plugin{
+		ServerType: "dns",
+		Action:     setup,
+	})
+}
+
+func setup(c *caddy.Controller) error {
+	e, err := parseEdge(c)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+
+	c.OnStartup(func() error {
+		return metrics.Register(c, requestCount, requestDuration, healthcheckFailureCount, routeDecisionCount, tableSize, serviceSetSize)
+	})
+
+	c.OnShutdown(func() error {
+		for _, p := range e.allProxies() {
+			p.Stop()
+		}
+		if e.Dnstap != nil {
+			e.Dnstap.Close()
+		}
+		if e.Bootstrap != nil {
+			e.Bootstrap.Stop()
+		}
+		return nil
+	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		e.Next = next
+		return e
+	})
+
+	return nil
+}
+
+// parseEdge parses a single `edge`/`forward` Corefile block into an Edge.
+func parseEdge(c *caddy.Controller) (*Edge, error) {
+	e := New()
+
+	var bootstrapHosts, upstreamHosts []string
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return nil, c.ArgErr()
+		}
+
+		routes, hosts, err := parseRoutes(args, e.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		upstreamHosts = append(upstreamHosts, hosts...)
+		e.addRoutes(routes)
+
+		// lineRoutes are the routes this line contributed to, so a `policy`
+		// sub-directive only governs them, not zoned routes from an earlier
+		// `edge`/`forward` occurrence in the same server block. A fallback
+		// (unzoned) route is merged into e.fallback by addRoutes, so it's
+		// e.fallback we track here, not the now-discarded route value; a
+		// policy set here therefore also governs the unzoned upstreams of
+		// earlier lines.
+		var lineRoutes []*route
+		for _, r := range routes {
+			if r.isFallback() {
+				lineRoutes = append(lineRoutes, e.fallback)
+				continue
+			}
+			lineRoutes = append(lineRoutes, r)
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "tls_servername":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				e.tlsServerName = c.Val()
+				e.tlsConfig.ServerName = c.Val()
+			case "force_tcp":
+				e.forceTCP = true
+			case "expire":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				e.expire = dur
+			case "max_fails":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				e.maxUpstreamFails = uint32(n)
+			case "policy":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				policy, err := newPolicy(c.Val())
+				if err != nil {
+					return nil, err
+				}
+				// A `policy` line governs only the routes parsed from this
+				// directive line, zoned or not.
+				for _, r := range lineRoutes {
+					r.policy = policy
+				}
+			case "bootstrap":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				bootstrapHosts = append(bootstrapHosts, args...)
+			case "dnstap":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				target := args[0]
+				full := len(args) > 1 && args[1] == "full"
+				dt, err := NewDnstap(target, full)
+				if err != nil {
+					return nil, err
+				}
+				e.Dnstap = dt
+			default:
+				return nil, c.Errf("unknown property %q", c.Val())
+			}
+		}
+	}
+
+	allProxies := e.allProxies()
+
+	if len(bootstrapHosts) > 0 && needsBootstrap(allProxies) {
+		bs := NewBootstrap(normalizeBootstrapHosts(bootstrapHosts))
+		bs.Run(upstreamHosts)
+		for _, p := range allProxies {
+			p.bootstrap = bs
+		}
+		e.Bootstrap = bs
+	}
+
+	for _, p := range allProxies {
+		if p.pool != nil {
+			p.pool.SetExpire(e.expire)
+		}
+		p.dnstap = e.Dnstap
+	}
+
+	return e, nil
+}
+
+// needsBootstrap reports whether any proxy was configured with a hostname
+// (rather than a literal IP) that therefore needs bootstrap resolution.
+func needsBootstrap(proxies []*Proxy) bool { return len(upstreamHostnames(proxies)) > 0 }
+
+// upstreamHostnames returns the hostnames (as opposed to literal IPs) used
+// by the given proxies.
+func upstreamHostnames(proxies []*Proxy) []string {
+	var hosts []string
+	for _, p := range proxies {
+		host := p.addr
+		if h, _, err := splitHostPortLoose(host); err == nil {
+			host = h
+		}
+		if isHostname(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func normalizeBootstrapHosts(hosts []string) []string {
+	out := make([]string, len(hosts))
+	for i, h := range hosts {
+		out[i] = strings.TrimSuffix(h, ".")
+	}
+	return out
+}
+
+// parseRoutes groups the tokens on a directive line into routes, honoring
+// the AdGuard-style `[/zone1/zone2/]upstream...` prefix: a bracketed token
+// opens a new route and every following upstream belongs to it, until
+// either another bracketed token or the end of the line. Upstreams given
+// before any bracket (or on a line with none at all) form the fallback
+// route. It returns the hostnames (not literal IPs) discovered along the
+// way, so the caller can decide whether bootstrap resolution is needed.
+func parseRoutes(args []string, tlsConfig *tls.Config) ([]*route, []string, error) {
+	var routes []*route
+	var hosts []string
+	var proxyCount int
+
+	cur := &route{policy: new(random)}
+	flush := func() {
+		if len(cur.proxies) > 0 {
+			routes = append(routes, cur)
+		}
+	}
+
+	for _, a := range args {
+		if zones, ok := parseZonePrefix(a); ok {
+			flush()
+			cur = &route{zones: zones, policy: new(random)}
+			continue
+		}
+
+		trans, addr, err := parseUpstreamAddr(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		p := NewProxy(trans, addr, tlsConfig)
+		cur.proxies = append(cur.proxies, p)
+		proxyCount++
+
+		host := p.addr
+		if h, _, err := splitHostPortLoose(host); err == nil {
+			host = h
+		}
+		if isHostname(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	flush()
+
+	if proxyCount > maxUpstreams {
+		return nil, nil, fmt.Errorf("more than %d TOs configured: %d", maxUpstreams, proxyCount)
+	}
+
+	return routes, hosts, nil
+}
+
+// parseZonePrefix recognizes a `[/zone1/zone2/]` token and returns its zones.
+func parseZonePrefix(a string) ([]string, bool) {
+	if !strings.HasPrefix(a, "[/") || !strings.HasSuffix(a, "/]") {
+		return nil, false
+	}
+	inner := strings.Trim(a, "[]")
+	var zones []string
+	for _, z := range strings.Split(inner, "/") {
+		if z != "" {
+			zones = append(zones, z)
+		}
+	}
+	return zones, true
+}
+
+// parseUpstreamAddr splits a single upstream token into its transport and
+// dial address, recognizing the tls://host@port, quic://host@port and
+// https://host/path forms alongside a bare host[:port] for plain DNS.
+func parseUpstreamAddr(a string) (transport, string, error) {
+	switch {
+	case strings.HasPrefix(a, "https://"):
+		return transportHTTPS, a, nil
+	case strings.HasPrefix(a, "quic://"):
+		addr := strings.TrimPrefix(a, "quic://")
+		addr = strings.Replace(addr, "@", ":", 1)
+		if !strings.Contains(addr, ":") {
+			addr += ":853"
+		}
+		return transportQUIC, addr, nil
+	case strings.HasPrefix(a, "tls://"):
+		addr := strings.TrimPrefix(a, "tls://")
+		addr = strings.Replace(addr, "@", ":", 1)
+		if !strings.Contains(addr, ":") {
+			addr += ":853"
+		}
+		return transportTLS, addr, nil
+	default:
+		addr := a
+		if !strings.Contains(addr, ":") {
+			addr += ":53"
+		}
+		return transportUDP, addr, nil
+	}
+}